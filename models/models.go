@@ -13,6 +13,7 @@ import (
 	"github.com/pivotal-cf/brokerapi"
 	"github.com/xenolf/lego/acme"
 
+	"github.com/18F/cf-cdn-service-broker/config"
 	"github.com/18F/cf-cdn-service-broker/utils"
 )
 
@@ -30,32 +31,62 @@ func (s State) Value() (driver.Value, error) {
 	return string(s), nil
 }
 
-// Unmarshal an `interface{}` to a `State` when reading from the database
+// Unmarshal an `interface{}` to a `State` when reading from the database.
+// Different drivers hand back a text column differently - lib/pq as
+// []byte, mattn/go-sqlite3 (used in tests) as string - so both are accepted.
 func (s *State) Scan(value interface{}) error {
-	bytes, ok := value.([]byte)
-	if !ok {
+	switch v := value.(type) {
+	case []byte:
+		*s = State(v)
+		return nil
+	case string:
+		*s = State(v)
+		return nil
+	default:
 		return fmt.Errorf("error scanning status %s", value)
 	}
-	*s = State(bytes)
-	return nil
 }
 
 type Route struct {
 	gorm.Model
-	InstanceId     string `gorm:"not null;unique_index"`
-	State          State  `gorm:"not null;index"`
-	DomainExternal string
-	DomainInternal string
-	DistId         string
-	Origin         string
-	Path           string
-	Certificate    Certificate
+	InstanceId        string `gorm:"not null;unique_index"`
+	State             State  `gorm:"not null;index"`
+	DomainExternal    string
+	DomainInternal    string
+	DistId            string
+	Origin            string
+	Path              string
+	InsecureOrigin    bool
+	ForwardedHeaders  string
+	ChallengeProvider string
+
+	// Viewer-certificate and caching knobs that fillDistributionConfig and
+	// SetCertificate used to hard-code. Persisted so a later Update that
+	// doesn't specify one of these preserves whatever was last chosen,
+	// matching the caller-reference preservation invariant documented on
+	// fillDistributionConfig.
+	PriceClass             string
+	ViewerProtocolPolicy   string
+	DefaultTTL             int64
+	Compress               bool
+	IPV6Enabled            bool
+	MinimumProtocolVersion string
+	SSLSupportMethod       string
+
+	Certificate Certificate
 }
 
 func (r *Route) GetDomains() []string {
 	return strings.Split(r.DomainExternal, ",")
 }
 
+func (r *Route) GetForwardedHeaders() []string {
+	if r.ForwardedHeaders == "" {
+		return []string{}
+	}
+	return strings.Split(r.ForwardedHeaders, ",")
+}
+
 type Certificate struct {
 	gorm.Model
 	RouteId     uint
@@ -73,32 +104,187 @@ func (c Certificate) Resource() acme.CertificateResource {
 	}
 }
 
+const (
+	InvalidationInProgress = "InProgress"
+	InvalidationCompleted  = "Completed"
+)
+
+type Invalidation struct {
+	gorm.Model
+	RouteID           uint
+	AWSInvalidationID string `gorm:"not null"`
+	CallerReference   string
+	Paths             string
+	Status            string `gorm:"not null;index"`
+}
+
+// TunableOptions holds the viewer-certificate and caching knobs that are
+// overridable both at provision time (CreateOptions) and later
+// (UpdateOptions). A nil field means "use the broker's configured default"
+// on Create, or "leave whatever was last chosen" on Update.
+type TunableOptions struct {
+	PriceClass             *string
+	ViewerProtocolPolicy   *string
+	DefaultTTL             *int64
+	Compress               *bool
+	IPV6Enabled            *bool
+	MinimumProtocolVersion *string
+	SSLSupportMethod       *string
+}
+
+// UpdateOptions carries the broker-facing `cf update-service` parameters
+// RouteManager.Update knows how to apply. A nil field means "leave this
+// attribute as it is on the persisted Route" rather than "clear it".
+type UpdateOptions struct {
+	DomainExternal   *string
+	Origin           *string
+	Path             *string
+	InsecureOrigin   *bool
+	ForwardedHeaders *[]string
+	Tags             *map[string]string
+
+	TunableOptions
+}
+
+// CreateOptions carries the broker-facing `cf create-service` parameters
+// RouteManager.Create can apply at provision time, on top of the required
+// instanceId/domain/origin/path. A nil field falls back to the operator's
+// configured broker-wide default.
+type CreateOptions struct {
+	ChallengeProvider *string
+
+	TunableOptions
+}
+
+// applyTunables overlays any non-nil field in opts onto r, leaving r's
+// current value in place for anything opts doesn't set.
+func applyTunables(r *Route, opts TunableOptions) {
+	if opts.PriceClass != nil {
+		r.PriceClass = *opts.PriceClass
+	}
+	if opts.ViewerProtocolPolicy != nil {
+		r.ViewerProtocolPolicy = *opts.ViewerProtocolPolicy
+	}
+	if opts.DefaultTTL != nil {
+		r.DefaultTTL = *opts.DefaultTTL
+	}
+	if opts.Compress != nil {
+		r.Compress = *opts.Compress
+	}
+	if opts.IPV6Enabled != nil {
+		r.IPV6Enabled = *opts.IPV6Enabled
+	}
+	if opts.MinimumProtocolVersion != nil {
+		r.MinimumProtocolVersion = *opts.MinimumProtocolVersion
+	}
+	if opts.SSLSupportMethod != nil {
+		r.SSLSupportMethod = *opts.SSLSupportMethod
+	}
+}
+
 type RouteManagerIface interface {
-	Create(instanceId, domain, origin, path string) (Route, error)
+	Create(instanceId, domain, origin, path string, opts CreateOptions) (Route, error)
 	Get(instanceId string) (Route, error)
-	Update(route Route) error
+	Update(instanceId string, opts UpdateOptions) error
+	Poll(route Route) error
 	Disable(route Route) error
 	Renew(route Route) error
 	RenewAll()
+	Invalidate(instanceId string, paths []string) (Invalidation, error)
+	InvalidateAll()
+}
+
+// OriginAccessIdentity caches the CloudFront origin access identity that
+// RouteManager provisions once per broker and reuses across every
+// distribution, so restarts don't leak orphaned OAIs.
+type OriginAccessIdentity struct {
+	gorm.Model
+	AWSId           string `gorm:"not null;unique_index"`
+	CanonicalUserId string `gorm:"not null"`
 }
 
 type RouteManager struct {
-	Iam        utils.IamIface
-	CloudFront utils.DistributionIface
-	Acme       utils.AcmeIface
-	DB         *gorm.DB
+	Settings             config.Settings
+	Iam                  utils.IamIface
+	CloudFront           utils.DistributionIface
+	Acme                 utils.AcmeIface
+	OriginAccessIdentity utils.OriginAccessIdentityIface
+	Bucket               utils.BucketIface
+	DNS                  utils.DNSIface
+	DB                   *gorm.DB
+}
+
+// dnsManaged reports whether the broker owns the external-domain -> dist
+// ALIAS record for its routes, which is true once an operator has
+// configured a Route53 hosted zone to automate it.
+func (m *RouteManager) dnsManaged() bool {
+	return m.Settings.DNSZoneId != ""
+}
+
+func (m *RouteManager) createAliases(r Route) error {
+	for _, domain := range r.GetDomains() {
+		if err := m.DNS.CreateAlias(m.Settings.DNSZoneId, domain, r.DomainInternal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RouteManager) deleteAliases(r Route) error {
+	for _, domain := range r.GetDomains() {
+		if err := m.DNS.DeleteAlias(m.Settings.DNSZoneId, domain, r.DomainInternal); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (m *RouteManager) Create(instanceId, domain, origin, path string) (Route, error) {
+// Create provisions a new distribution. opts.ChallengeProvider lets a single
+// instance opt into DNS-01 (e.g. for a wildcard domain) even when the broker
+// defaults to HTTP-01, or vice versa.
+func (m *RouteManager) Create(instanceId, domain, origin, path string, opts CreateOptions) (Route, error) {
+	challenge := utils.ChallengeProvider(m.Settings.DefaultChallengeProvider)
+	if opts.ChallengeProvider != nil {
+		challenge = utils.ChallengeProvider(*opts.ChallengeProvider)
+	}
+	if challenge == "" {
+		challenge = utils.ChallengeHTTP01
+	}
+	if err := utils.ValidateChallengeProvider(challenge); err != nil {
+		return Route{}, err
+	}
+
 	route := Route{
-		InstanceId:     instanceId,
-		State:          Provisioning,
-		DomainExternal: domain,
-		Origin:         origin,
-		Path:           path,
+		InstanceId:             instanceId,
+		State:                  Provisioning,
+		DomainExternal:         domain,
+		Origin:                 origin,
+		Path:                   path,
+		ChallengeProvider:      string(challenge),
+		PriceClass:             firstNonEmpty(m.Settings.DefaultPriceClass, "PriceClass_100"),
+		ViewerProtocolPolicy:   firstNonEmpty(m.Settings.DefaultViewerProtocolPolicy, "redirect-to-https"),
+		DefaultTTL:             firstNonZero(m.Settings.DefaultCacheTTL, 86400),
+		Compress:               m.Settings.DefaultCompress,
+		IPV6Enabled:            !m.Settings.DisableIPV6,
+		MinimumProtocolVersion: firstNonEmpty(m.Settings.DefaultMinimumProtocolVersion, "TLSv1"),
+		SSLSupportMethod:       firstNonEmpty(m.Settings.DefaultSSLSupportMethod, "sni-only"),
 	}
+	applyTunables(&route, opts.TunableOptions)
 
-	dist, err := m.CloudFront.Create(route.GetDomains(), origin, path)
+	if err := utils.ValidateMinimumProtocolVersion(route.MinimumProtocolVersion); err != nil {
+		return Route{}, err
+	}
+	if err := utils.ValidateSSLSupportMethod(route.SSLSupportMethod, m.Settings.AllowDedicatedIPSSL); err != nil {
+		return Route{}, err
+	}
+
+	if challenge != utils.ChallengeDNS01 {
+		if err := m.ensureOriginAccessIdentity(); err != nil {
+			return Route{}, err
+		}
+	}
+
+	dist, err := m.CloudFront.Create(m.distributionOptions(route, nil))
 	if err != nil {
 		return Route{}, err
 	}
@@ -110,6 +296,39 @@ func (m *RouteManager) Create(instanceId, domain, origin, path string) (Route, e
 	return route, nil
 }
 
+// distributionOptions builds the utils.DistributionOptions CloudFront.Create
+// and CloudFront.Update need out of a route's persisted settings.
+func (m *RouteManager) distributionOptions(r Route, tags map[string]string) utils.DistributionOptions {
+	return utils.DistributionOptions{
+		Domains:              r.GetDomains(),
+		Origin:               r.Origin,
+		Path:                 r.Path,
+		InsecureOrigin:       r.InsecureOrigin,
+		ForwardedHeaders:     r.GetForwardedHeaders(),
+		Tags:                 tags,
+		Challenge:            utils.ChallengeProvider(r.ChallengeProvider),
+		PriceClass:           r.PriceClass,
+		ViewerProtocolPolicy: r.ViewerProtocolPolicy,
+		DefaultTTL:           r.DefaultTTL,
+		Compress:             r.Compress,
+		IPV6Enabled:          r.IPV6Enabled,
+	}
+}
+
+func firstNonEmpty(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func firstNonZero(value, fallback int64) int64 {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
 func (m *RouteManager) Get(instanceId string) (Route, error) {
 	route := Route{}
 	result := m.DB.First(&route, Route{InstanceId: instanceId})
@@ -122,7 +341,10 @@ func (m *RouteManager) Get(instanceId string) (Route, error) {
 	}
 }
 
-func (m *RouteManager) Update(r Route) error {
+// Poll advances r's state machine one step based on its current State. It's
+// called periodically by a background worker for every route that isn't yet
+// in a terminal state (Provisioned/Deprovisioned).
+func (m *RouteManager) Poll(r Route) error {
 	switch r.State {
 	case Provisioning:
 		return m.updateProvisioning(r)
@@ -133,6 +355,107 @@ func (m *RouteManager) Update(r Route) error {
 	}
 }
 
+// Update applies opts to the persisted route and, for anything CloudFront
+// needs to know about (origin, path, insecure-origin, forwarded headers,
+// domains), pushes the change via CloudFront.Update. fillDistributionConfig
+// always re-sends the distribution's existing CallerReference, so none of
+// this disturbs the caller-reference-as-id invariant it documents.
+//
+// Changing the domain list affects the certificate's SAN entries, so rather
+// than re-issue synchronously, Update just drops the route back into
+// Provisioning; the next Poll re-checks CNAME/hosts and re-runs ACME
+// issuance via provisionCert/deployCertificate, same as initial
+// provisioning. If the broker owns the ALIAS records for this route, any
+// domain dropped from the list is cleaned up immediately rather than left
+// pointing at the distribution forever - createAliases will pick up any
+// newly-added domain on a later Poll, just before the certificate is
+// re-issued.
+func (m *RouteManager) Update(instanceId string, opts UpdateOptions) error {
+	route, err := m.Get(instanceId)
+	if err != nil {
+		return err
+	}
+
+	oldDomains := route.GetDomains()
+	domainsChanged := opts.DomainExternal != nil && *opts.DomainExternal != route.DomainExternal
+
+	if opts.DomainExternal != nil {
+		route.DomainExternal = *opts.DomainExternal
+	}
+	if opts.Origin != nil {
+		route.Origin = *opts.Origin
+	}
+	if opts.Path != nil {
+		route.Path = *opts.Path
+	}
+	if opts.InsecureOrigin != nil {
+		route.InsecureOrigin = *opts.InsecureOrigin
+	}
+	if opts.ForwardedHeaders != nil {
+		route.ForwardedHeaders = strings.Join(*opts.ForwardedHeaders, ",")
+	}
+	applyTunables(&route, opts.TunableOptions)
+
+	if err := utils.ValidateMinimumProtocolVersion(route.MinimumProtocolVersion); err != nil {
+		return err
+	}
+	if err := utils.ValidateSSLSupportMethod(route.SSLSupportMethod, m.Settings.AllowDedicatedIPSSL); err != nil {
+		return err
+	}
+
+	_, err = m.CloudFront.Update(route.DistId, m.distributionOptions(route, nil))
+	if err != nil {
+		return err
+	}
+
+	if opts.Tags != nil {
+		if err := m.CloudFront.Tag(route.DistId, *opts.Tags); err != nil {
+			return err
+		}
+	}
+
+	// A MinimumProtocolVersion/SSLSupportMethod change only takes effect
+	// the next time SetCertificate runs, via deployCertificate - rather
+	// than re-upload the existing certificate here just to re-apply it,
+	// the next scheduled Renew will pick the new values up off the route.
+
+	if domainsChanged && m.dnsManaged() {
+		if err := m.deleteDroppedAliases(oldDomains, route); err != nil {
+			return err
+		}
+	}
+
+	if domainsChanged {
+		route.State = Provisioning
+	}
+
+	m.DB.Save(&route)
+
+	return nil
+}
+
+// deleteDroppedAliases removes the Route53 ALIAS record for every domain in
+// oldDomains that r.GetDomains() no longer includes, so an Update that
+// shrinks or replaces a route's domain list doesn't leak a stale ALIAS
+// pointing at the distribution.
+func (m *RouteManager) deleteDroppedAliases(oldDomains []string, r Route) error {
+	kept := map[string]bool{}
+	for _, domain := range r.GetDomains() {
+		kept[domain] = true
+	}
+
+	for _, domain := range oldDomains {
+		if kept[domain] {
+			continue
+		}
+		if err := m.DNS.DeleteAlias(m.Settings.DNSZoneId, domain, r.DomainInternal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (m *RouteManager) Disable(r Route) error {
 	err := m.CloudFront.Disable(r.DistId)
 	if err != nil {
@@ -155,7 +478,7 @@ func (m *RouteManager) Renew(r Route) error {
 		return err
 	}
 
-	err = m.deployCertificate(r.DomainExternal, r.DistId, certResource)
+	err = m.deployCertificate(r, certResource)
 	if err != nil {
 		return err
 	}
@@ -190,8 +513,73 @@ func (m *RouteManager) RenewAll() {
 	}
 }
 
+// Invalidate requests that CloudFront purge the given paths from its edge
+// caches for the distribution backing instanceId, and persists a record of
+// the request so InvalidateAll can later poll it to completion.
+func (m *RouteManager) Invalidate(instanceId string, paths []string) (Invalidation, error) {
+	route, err := m.Get(instanceId)
+	if err != nil {
+		return Invalidation{}, err
+	}
+
+	awsInvalidationId, callerReference, err := m.CloudFront.CreateInvalidation(route.DistId, paths)
+	if err != nil {
+		return Invalidation{}, err
+	}
+
+	invalidation := Invalidation{
+		RouteID:           route.ID,
+		AWSInvalidationID: awsInvalidationId,
+		CallerReference:   callerReference,
+		Paths:             strings.Join(paths, ","),
+		Status:            InvalidationInProgress,
+	}
+	m.DB.Create(&invalidation)
+
+	return invalidation, nil
+}
+
+// InvalidateAll polls CloudFront for every invalidation still marked
+// `InProgress` and transitions it to `Completed` once CloudFront reports it
+// as done, mirroring the RenewAll background poller.
+func (m *RouteManager) InvalidateAll() {
+	invalidations := []Invalidation{}
+
+	m.DB.Where("status = ?", InvalidationInProgress).Find(&invalidations)
+
+	for _, invalidation := range invalidations {
+		var route Route
+		m.DB.First(&route, invalidation.RouteID)
+
+		status, err := m.CloudFront.GetInvalidation(route.DistId, invalidation.AWSInvalidationID)
+		if err != nil {
+			continue
+		}
+
+		if status == InvalidationCompleted {
+			invalidation.Status = InvalidationCompleted
+			m.DB.Save(&invalidation)
+		}
+	}
+}
+
 func (m *RouteManager) updateProvisioning(r Route) error {
-	if (m.checkCNAME(r) || m.checkHosts(r)) && m.checkDistribution(r) {
+	// When the broker owns the ALIAS record (dnsManaged), there's no
+	// operator-created CNAME to wait on - only the distribution itself
+	// needs to finish deploying.
+	domainReady := m.dnsManaged() || m.checkCNAME(r) || m.checkHosts(r)
+
+	if domainReady && m.checkDistribution(r) {
+		if m.dnsManaged() {
+			// The ALIAS has to exist before Let's Encrypt's HTTP-01
+			// validator can reach the distribution, so this has to run
+			// before provisionCert, not after - a DNS-automated route can
+			// never obtain a cert otherwise.
+			if err := m.createAliases(r); err != nil {
+				return err
+			}
+		}
+
 		certResource, err := m.provisionCert(r)
 		if err != nil {
 			return err
@@ -230,6 +618,16 @@ func (m *RouteManager) updateDeprovisioning(r Route) error {
 			return err
 		}
 
+		if m.dnsManaged() {
+			if err := m.deleteAliases(r); err != nil {
+				return err
+			}
+		}
+
+		if err := m.releaseOriginAccessIdentity(r); err != nil {
+			return err
+		}
+
 		r.State = Deprovisioned
 		m.DB.Save(&r)
 	}
@@ -238,12 +636,17 @@ func (m *RouteManager) updateDeprovisioning(r Route) error {
 }
 
 func (m *RouteManager) provisionCert(r Route) (acme.CertificateResource, error) {
-	cert, err := m.Acme.ObtainCertificate(r.GetDomains())
+	challenge := utils.ChallengeProvider(r.ChallengeProvider)
+	if challenge == "" {
+		challenge = utils.ChallengeHTTP01
+	}
+
+	cert, err := m.Acme.ObtainCertificate(r.GetDomains(), challenge)
 	if err != nil {
 		return acme.CertificateResource{}, err
 	}
 
-	err = m.deployCertificate(r.DomainExternal, r.DistId, cert)
+	err = m.deployCertificate(r, cert)
 	if err != nil {
 		return acme.CertificateResource{}, err
 	}
@@ -251,6 +654,66 @@ func (m *RouteManager) provisionCert(r Route) (acme.CertificateResource, error)
 	return cert, nil
 }
 
+// ensureOriginAccessIdentity hands the broker's shared CloudFront OAI id to
+// CloudFront.SetOriginAccessIdentityId, creating the OAI (and locking down
+// the challenge bucket to it) the first time it's needed, and caching it in
+// the DB for every call after.
+func (m *RouteManager) ensureOriginAccessIdentity() error {
+	var oai OriginAccessIdentity
+	result := m.DB.First(&oai)
+	if result.Error == nil {
+		m.CloudFront.SetOriginAccessIdentityId(oai.AWSId)
+		return nil
+	} else if !result.RecordNotFound() {
+		return result.Error
+	}
+
+	awsId, canonicalUserId, err := m.OriginAccessIdentity.Create("cdn-route-service-broker")
+	if err != nil {
+		return err
+	}
+
+	if err := m.Bucket.LockdownToCanonicalUser(m.Settings.Bucket, canonicalUserId); err != nil {
+		return err
+	}
+
+	oai = OriginAccessIdentity{AWSId: awsId, CanonicalUserId: canonicalUserId}
+	m.DB.Create(&oai)
+
+	m.CloudFront.SetOriginAccessIdentityId(awsId)
+	return nil
+}
+
+// releaseOriginAccessIdentity deletes the broker's shared OAI once r is the
+// last non-deprovisioned, non-DNS-01 route that could still be relying on
+// it - DNS-01 routes never call ensureOriginAccessIdentity, so they don't
+// count. If any other route is still using it, the OAI (and the bucket
+// lockdown pointing at it) is left alone.
+func (m *RouteManager) releaseOriginAccessIdentity(r Route) error {
+	var oai OriginAccessIdentity
+	result := m.DB.First(&oai)
+	if result.RecordNotFound() {
+		return nil
+	} else if result.Error != nil {
+		return result.Error
+	}
+
+	var remaining int
+	m.DB.Model(&Route{}).Where(
+		"id != ? and state != ? and challenge_provider != ?",
+		r.ID, string(Deprovisioned), string(utils.ChallengeDNS01),
+	).Count(&remaining)
+	if remaining > 0 {
+		return nil
+	}
+
+	if err := m.OriginAccessIdentity.Delete(oai.AWSId); err != nil {
+		return err
+	}
+
+	return m.DB.Delete(&oai).Error
+}
+
 func (m *RouteManager) checkCNAME(r Route) bool {
 	expects := fmt.Sprintf("%s.", r.DomainInternal)
 
@@ -294,16 +757,20 @@ func (m *RouteManager) checkDistribution(r Route) bool {
 	return *dist.Status == "Deployed" && *dist.DistributionConfig.Enabled
 }
 
-func (m *RouteManager) deployCertificate(domain, distId string, cert acme.CertificateResource) error {
-	prev := fmt.Sprintf("cdn-route-%s-new", domain)
-	next := fmt.Sprintf("cdn-route-%s", domain)
+func (m *RouteManager) deployCertificate(r Route, cert acme.CertificateResource) error {
+	prev := fmt.Sprintf("cdn-route-%s-new", r.DomainExternal)
+	next := fmt.Sprintf("cdn-route-%s", r.DomainExternal)
 
 	certId, err := m.Iam.UploadCertificate(prev, cert)
 	if err != nil {
 		return err
 	}
 
-	err = m.CloudFront.SetCertificate(distId, certId)
+	err = m.CloudFront.SetCertificate(r.DistId, utils.CertificateOptions{
+		CertId:                 certId,
+		MinimumProtocolVersion: firstNonEmpty(r.MinimumProtocolVersion, "TLSv1"),
+		SSLSupportMethod:       firstNonEmpty(r.SSLSupportMethod, "sni-only"),
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,316 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/xenolf/lego/acme"
+
+	"github.com/18F/cf-cdn-service-broker/config"
+	"github.com/18F/cf-cdn-service-broker/utils"
+)
+
+// fakeDistribution is a minimal DistributionIface double. Its
+// CreateInvalidation always returns a fixed, known caller reference so
+// tests can assert RouteManager persists that exact value rather than
+// reconstructing its own guess at it.
+type fakeDistribution struct {
+	invalidationId        string
+	invalidationCallerRef string
+}
+
+func (f *fakeDistribution) Create(opts utils.DistributionOptions) (*cloudfront.Distribution, error) {
+	return &cloudfront.Distribution{
+		Id:         aws.String("dist-1"),
+		DomainName: aws.String("dist-1.cloudfront.net"),
+	}, nil
+}
+
+func (f *fakeDistribution) Update(distId string, opts utils.DistributionOptions) (*cloudfront.Distribution, error) {
+	return &cloudfront.Distribution{Id: aws.String(distId)}, nil
+}
+
+func (f *fakeDistribution) Get(distId string) (*cloudfront.Distribution, error) {
+	return &cloudfront.Distribution{
+		Id:                 aws.String(distId),
+		Status:             aws.String("Deployed"),
+		DistributionConfig: &cloudfront.DistributionConfig{Enabled: aws.Bool(true)},
+	}, nil
+}
+
+func (f *fakeDistribution) SetCertificate(distId string, opts utils.CertificateOptions) error {
+	return nil
+}
+
+func (f *fakeDistribution) Disable(distId string) error { return nil }
+
+func (f *fakeDistribution) Delete(distId string) (bool, error) { return true, nil }
+
+func (f *fakeDistribution) CreateInvalidation(distId string, paths []string) (string, string, error) {
+	return f.invalidationId, f.invalidationCallerRef, nil
+}
+
+func (f *fakeDistribution) GetInvalidation(distId, invalidationId string) (string, error) {
+	return InvalidationCompleted, nil
+}
+
+func (f *fakeDistribution) SetOriginAccessIdentityId(oaiId string) {}
+
+func (f *fakeDistribution) Tag(distId string, tags map[string]string) error { return nil }
+
+type fakeIam struct{}
+
+func (f *fakeIam) UploadCertificate(name string, cert acme.CertificateResource) (string, error) {
+	return "cert-id", nil
+}
+
+func (f *fakeIam) RenameCertificate(prevName, nextName string) error { return nil }
+
+func (f *fakeIam) DeleteCertificate(name string, detachOnly bool) error { return nil }
+
+type fakeAcme struct{}
+
+func (f *fakeAcme) ObtainCertificate(domains []string, challenge utils.ChallengeProvider) (acme.CertificateResource, error) {
+	return acme.CertificateResource{Domain: domains[0]}, nil
+}
+
+func (f *fakeAcme) RenewCertificate(cert acme.CertificateResource) (acme.CertificateResource, error) {
+	return cert, nil
+}
+
+// fakeOrderedAcme models the real constraint that makes the ALIAS-before-cert
+// ordering matter: HTTP-01 validation can't reach a distribution that isn't
+// resolvable yet, so ObtainCertificate fails unless dns already has an alias
+// for every domain being issued. A test built on it fails under the ordering
+// bug (createAliases running after provisionCert) instead of passing either
+// way.
+type fakeOrderedAcme struct {
+	dns  *fakeDNS
+	cert []byte
+}
+
+func (f *fakeOrderedAcme) ObtainCertificate(domains []string, challenge utils.ChallengeProvider) (acme.CertificateResource, error) {
+	for _, domain := range domains {
+		found := false
+		for _, created := range f.dns.created {
+			if created == domain {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return acme.CertificateResource{}, fmt.Errorf("domain %s has no DNS alias yet; HTTP-01 validation would fail", domain)
+		}
+	}
+
+	return acme.CertificateResource{Domain: domains[0], Certificate: f.cert}, nil
+}
+
+func (f *fakeOrderedAcme) RenewCertificate(cert acme.CertificateResource) (acme.CertificateResource, error) {
+	return cert, nil
+}
+
+// testCertPEM generates a throwaway self-signed certificate so tests that
+// exercise provisionCert's GetPEMCertExpiration call have something parsable
+// to work with.
+func testCertPEM(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating test key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(1, 0, 0),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating test certificate: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+type fakeBucket struct{}
+
+func (f *fakeBucket) LockdownToCanonicalUser(bucket, canonicalUserId string) error { return nil }
+
+type fakeOriginAccessIdentity struct{}
+
+func (f *fakeOriginAccessIdentity) Create(comment string) (string, string, error) {
+	return "oai-1", "canonical-1", nil
+}
+
+func (f *fakeOriginAccessIdentity) Delete(oaiId string) error { return nil }
+
+// fakeDNS records every CreateAlias/DeleteAlias call so tests can assert on
+// exactly which domains were touched.
+type fakeDNS struct {
+	created []string
+	deleted []string
+}
+
+func (f *fakeDNS) CreateAlias(hostedZoneId, domain, target string) error {
+	f.created = append(f.created, domain)
+	return nil
+}
+
+func (f *fakeDNS) DeleteAlias(hostedZoneId, domain, target string) error {
+	f.deleted = append(f.deleted, domain)
+	return nil
+}
+
+func testRouteManager(t *testing.T, dns utils.DNSIface, dnsZoneId string, dist utils.DistributionIface) (*RouteManager, *gorm.DB) {
+	return testRouteManagerWithAcme(t, dns, dnsZoneId, dist, &fakeAcme{})
+}
+
+func testRouteManagerWithAcme(t *testing.T, dns utils.DNSIface, dnsZoneId string, dist utils.DistributionIface, acmeClient utils.AcmeIface) (*RouteManager, *gorm.DB) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("opening test database: %s", err)
+	}
+	db.AutoMigrate(&Route{}, &Certificate{}, &Invalidation{}, &OriginAccessIdentity{})
+
+	return &RouteManager{
+		Settings:             config.Settings{DNSZoneId: dnsZoneId},
+		Iam:                  &fakeIam{},
+		CloudFront:           dist,
+		Acme:                 acmeClient,
+		OriginAccessIdentity: &fakeOriginAccessIdentity{},
+		Bucket:               &fakeBucket{},
+		DNS:                  dns,
+		DB:                   db,
+	}, db
+}
+
+// TestUpdateDomainChangeCleansUpStaleAliases covers the Update state
+// transition this request series added: dropping a domain from
+// DomainExternal should delete that domain's Route53 ALIAS record
+// immediately, not leave it pointing at the distribution forever, while a
+// domain that's kept (or newly added) is left for createAliases to pick up
+// once the route re-validates.
+func TestUpdateDomainChangeCleansUpStaleAliases(t *testing.T) {
+	dns := &fakeDNS{}
+	manager, db := testRouteManager(t, dns, "Z123", &fakeDistribution{})
+
+	route := Route{
+		InstanceId:             "instance-1",
+		State:                  Provisioned,
+		DomainExternal:         "old.example.com,shared.example.com",
+		DomainInternal:         "dist-1.cloudfront.net",
+		DistId:                 "dist-1",
+		ChallengeProvider:      string(utils.ChallengeHTTP01),
+		PriceClass:             "PriceClass_100",
+		ViewerProtocolPolicy:   "redirect-to-https",
+		DefaultTTL:             86400,
+		MinimumProtocolVersion: "TLSv1",
+		SSLSupportMethod:       "sni-only",
+	}
+	db.Create(&route)
+
+	newDomains := "new.example.com,shared.example.com"
+	if err := manager.Update("instance-1", UpdateOptions{DomainExternal: &newDomains}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	if len(dns.deleted) != 1 || dns.deleted[0] != "old.example.com" {
+		t.Fatalf("expected only old.example.com to be deleted, got %v", dns.deleted)
+	}
+
+	updated, err := manager.Get("instance-1")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if updated.State != Provisioning {
+		t.Fatalf("expected State to be Provisioning after a domain change, got %s", updated.State)
+	}
+}
+
+// TestInvalidatePersistsCloudFrontCallerReference covers the Invalidate
+// state transition this request series added: the persisted
+// Invalidation.CallerReference must be the exact value CloudFront.CreateInvalidation
+// used, not an independently fabricated one.
+func TestInvalidatePersistsCloudFrontCallerReference(t *testing.T) {
+	dist := &fakeDistribution{invalidationId: "cf-inval-1", invalidationCallerRef: "dist-1-123456789"}
+	manager, db := testRouteManager(t, &fakeDNS{}, "", dist)
+
+	route := Route{
+		InstanceId: "instance-1",
+		State:      Provisioned,
+		DistId:     "dist-1",
+	}
+	db.Create(&route)
+
+	invalidation, err := manager.Invalidate("instance-1", []string{"/*"})
+	if err != nil {
+		t.Fatalf("Invalidate: %s", err)
+	}
+
+	if invalidation.AWSInvalidationID != dist.invalidationId {
+		t.Fatalf("AWSInvalidationID = %s, want %s", invalidation.AWSInvalidationID, dist.invalidationId)
+	}
+	if invalidation.CallerReference != dist.invalidationCallerRef {
+		t.Fatalf("CallerReference = %s, want %s (the value CloudFront actually used)", invalidation.CallerReference, dist.invalidationCallerRef)
+	}
+	if invalidation.Status != InvalidationInProgress {
+		t.Fatalf("Status = %s, want %s", invalidation.Status, InvalidationInProgress)
+	}
+}
+
+// TestUpdateProvisioningCreatesAliasesBeforeCert covers the ordering this
+// request series fixed: for a dnsManaged route on the default HTTP-01
+// challenge, updateProvisioning must create the Route53 ALIAS before calling
+// provisionCert, since HTTP-01 validation can only reach the distribution
+// once that ALIAS resolves. fakeOrderedAcme fails ObtainCertificate if the
+// alias isn't there yet, so this test would have failed under the old
+// cert-then-alias ordering.
+func TestUpdateProvisioningCreatesAliasesBeforeCert(t *testing.T) {
+	dns := &fakeDNS{}
+	acmeClient := &fakeOrderedAcme{dns: dns, cert: testCertPEM(t)}
+	manager, db := testRouteManagerWithAcme(t, dns, "Z123", &fakeDistribution{}, acmeClient)
+
+	route := Route{
+		InstanceId:             "instance-1",
+		State:                  Provisioning,
+		DomainExternal:         "www.example.com",
+		DomainInternal:         "dist-1.cloudfront.net",
+		DistId:                 "dist-1",
+		ChallengeProvider:      string(utils.ChallengeHTTP01),
+		PriceClass:             "PriceClass_100",
+		ViewerProtocolPolicy:   "redirect-to-https",
+		DefaultTTL:             86400,
+		MinimumProtocolVersion: "TLSv1",
+		SSLSupportMethod:       "sni-only",
+	}
+	db.Create(&route)
+
+	if err := manager.Poll(route); err != nil {
+		t.Fatalf("Poll: %s", err)
+	}
+
+	if len(dns.created) != 1 || dns.created[0] != "www.example.com" {
+		t.Fatalf("expected www.example.com to have an ALIAS created, got %v", dns.created)
+	}
+
+	updated, err := manager.Get("instance-1")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if updated.State != Provisioned {
+		t.Fatalf("expected State to be Provisioned, got %s", updated.State)
+	}
+}
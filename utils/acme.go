@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"github.com/xenolf/lego/acme"
+	"github.com/xenolf/lego/providers/dns/route53"
+)
+
+// AcmeIface issues and renews the certificates RouteManager attaches to a
+// distribution via SetCertificate.
+type AcmeIface interface {
+	ObtainCertificate(domains []string, challenge ChallengeProvider) (acme.CertificateResource, error)
+	RenewCertificate(cert acme.CertificateResource) (acme.CertificateResource, error)
+}
+
+// Acme wraps a lego client that's already configured with an HTTP-01
+// provider (the S3-origin-backed /.well-known/acme-challenge/* cache
+// behavior fillDistributionConfig builds), and adds a Route53 DNS-01
+// provider when a route asks for DNS-01 - the only way to issue a wildcard
+// cert, since HTTP-01 can't. Once added, the DNS-01 provider stays
+// registered on the client alongside the HTTP-01 one for every later
+// request; nothing removes it.
+type Acme struct {
+	Client *acme.Client
+}
+
+func (a *Acme) ObtainCertificate(domains []string, challenge ChallengeProvider) (acme.CertificateResource, error) {
+	if err := a.useChallenge(challenge); err != nil {
+		return acme.CertificateResource{}, err
+	}
+
+	cert, err := a.Client.ObtainCertificate(domains, true, nil, false)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+
+	return *cert, nil
+}
+
+func (a *Acme) RenewCertificate(cert acme.CertificateResource) (acme.CertificateResource, error) {
+	renewed, err := a.Client.RenewCertificate(cert, true, false)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+
+	return *renewed, nil
+}
+
+// useChallenge points the client at the Route53 DNS-01 provider when asked,
+// and otherwise leaves its existing HTTP-01 provider in place.
+func (a *Acme) useChallenge(challenge ChallengeProvider) error {
+	if challenge != ChallengeDNS01 {
+		return nil
+	}
+
+	provider, err := route53.NewDNSProvider()
+	if err != nil {
+		return err
+	}
+
+	return a.Client.SetChallengeProvider(acme.DNS01, provider)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/18F/cf-cdn-service-broker/config"
+)
+
+// BucketIface locks an S3 bucket down to a single principal, namely the
+// CloudFront origin access identity fronting it.
+type BucketIface interface {
+	LockdownToCanonicalUser(bucket, canonicalUserId string) error
+}
+
+type Bucket struct {
+	Settings config.Settings
+	Service  *s3.S3
+}
+
+type bucketPolicy struct {
+	Version   string
+	Statement []bucketPolicyStatement
+}
+
+type bucketPolicyStatement struct {
+	Sid       string
+	Effect    string
+	Principal map[string]string
+	Action    string
+	Resource  string
+}
+
+// LockdownToCanonicalUser replaces bucket's policy with one that grants
+// s3:GetObject only to the given CloudFront OAI canonical user, so the
+// bucket can stop being world-readable once the distribution fronts it
+// through that OAI.
+func (b *Bucket) LockdownToCanonicalUser(bucket, canonicalUserId string) error {
+	policy := bucketPolicy{
+		Version: "2012-10-17",
+		Statement: []bucketPolicyStatement{
+			{
+				Sid:       "CloudFrontOriginAccessIdentityReadOnly",
+				Effect:    "Allow",
+				Principal: map[string]string{"CanonicalUser": canonicalUserId},
+				Action:    "s3:GetObject",
+				Resource:  fmt.Sprintf("arn:%s:s3:::%s/*", b.Settings.AwsPartition, bucket),
+			},
+		},
+	}
+
+	document, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Service.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucket),
+		Policy: aws.String(string(document)),
+	})
+
+	return err
+}
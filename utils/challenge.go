@@ -0,0 +1,13 @@
+package utils
+
+// ChallengeProvider selects which ACME challenge type a route proves domain
+// ownership with. HTTP01 needs the distribution to expose
+// /.well-known/acme-challenge/* over an S3 origin; DNS01 needs neither,
+// since proof of ownership happens out-of-band via a Route53 TXT record,
+// which is what makes it the only option for wildcard certs.
+type ChallengeProvider string
+
+const (
+	ChallengeHTTP01 ChallengeProvider = "http-01"
+	ChallengeDNS01  ChallengeProvider = "dns-01"
+)
@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
@@ -10,18 +11,61 @@ import (
 	"github.com/18F/cf-cdn-service-broker/config"
 )
 
+// DistributionOptions gathers everything fillDistributionConfig needs. It
+// grew out of a long positional parameter list once the viewer-certificate
+// and caching knobs below became operator/plan-tunable instead of the
+// hard-coded values this package used to bake in.
+type DistributionOptions struct {
+	Domains          []string
+	Origin           string
+	Path             string
+	InsecureOrigin   bool
+	ForwardedHeaders []string
+	Tags             map[string]string
+	Challenge        ChallengeProvider
+
+	PriceClass           string
+	ViewerProtocolPolicy string
+	DefaultTTL           int64
+	Compress             bool
+	IPV6Enabled          bool
+}
+
+// CertificateOptions gathers the viewer-certificate knobs SetCertificate
+// applies alongside the IAM certificate id.
+type CertificateOptions struct {
+	CertId                 string
+	MinimumProtocolVersion string
+	SSLSupportMethod       string
+}
+
 type DistributionIface interface {
-	Create(domains []string, origin, path string, insecureOrigin bool, forwardedHeaders []string, tags map[string]string) (*cloudfront.Distribution, error)
-	Update(distId string, domains []string, origin, path string, insecureOrigin bool, forwardedHeaders []string) (*cloudfront.Distribution, error)
+	Create(opts DistributionOptions) (*cloudfront.Distribution, error)
+	Update(distId string, opts DistributionOptions) (*cloudfront.Distribution, error)
 	Get(distId string) (*cloudfront.Distribution, error)
-	SetCertificate(distId, certId string) error
+	SetCertificate(distId string, opts CertificateOptions) error
 	Disable(distId string) error
 	Delete(distId string) (bool, error)
+	CreateInvalidation(distId string, paths []string) (invalidationId, callerReference string, err error)
+	GetInvalidation(distId, invalidationId string) (string, error)
+	SetOriginAccessIdentityId(oaiId string)
+	Tag(distId string, tags map[string]string) error
 }
 
 type Distribution struct {
 	Settings config.Settings
 	Service  *cloudfront.CloudFront
+
+	// originAccessIdentityId is the id of the CloudFront origin access
+	// identity used to lock down the challenge bucket origin. It's set once
+	// via SetOriginAccessIdentityId by whoever owns its lifecycle (normally
+	// RouteManager, which creates and caches it lazily) and left empty
+	// ("") to fall back to the previous world-readable-bucket behavior.
+	originAccessIdentityId string
+}
+
+func (d *Distribution) SetOriginAccessIdentityId(oaiId string) {
+	d.originAccessIdentityId = oaiId
 }
 
 func (d *Distribution) getDistributionId(domains []string) string {
@@ -54,6 +98,16 @@ func (d *Distribution) getTags(tags map[string]string) *cloudfront.Tags {
 	return &cloudfront.Tags{Items: items}
 }
 
+// getOriginAccessIdentity returns the S3OriginConfig.OriginAccessIdentity
+// value for the challenge bucket origin. Empty means "no OAI", which leaves
+// the bucket world-readable as before.
+func (d *Distribution) getOriginAccessIdentity() string {
+	if d.originAccessIdentityId == "" {
+		return ""
+	}
+	return fmt.Sprintf("origin-access-identity/cloudfront/%s", d.originAccessIdentityId)
+}
+
 func (d *Distribution) getHeaders(headers []string) *cloudfront.Headers {
 	items := make([]*string, len(headers))
 	for idx, header := range headers {
@@ -72,16 +126,15 @@ func (d *Distribution) getHeaders(headers []string) *cloudfront.Headers {
 // update, the domains could change but we need to treat the CallerReference like an ID because
 // it can't be changed like the domains and instead the callerReference which was composed of the original domains must
 // be passed in.
-func (d *Distribution) fillDistributionConfig(config *cloudfront.DistributionConfig, origin, path string,
-	insecureOrigin bool, callerReference *string, domains []string, forwardedHeaders []string) {
+func (d *Distribution) fillDistributionConfig(config *cloudfront.DistributionConfig, callerReference *string, opts DistributionOptions) {
 	config.CallerReference = callerReference
 	config.Comment = aws.String("cdn route service")
 	config.Enabled = aws.Bool(true)
-	config.IsIPV6Enabled = aws.Bool(true)
+	config.IsIPV6Enabled = aws.Bool(opts.IPV6Enabled)
 	config.DefaultCacheBehavior = &cloudfront.DefaultCacheBehavior{
-		TargetOriginId: aws.String(d.getOriginId(domains)),
+		TargetOriginId: aws.String(d.getOriginId(opts.Domains)),
 		ForwardedValues: &cloudfront.ForwardedValues{
-			Headers: d.getHeaders(forwardedHeaders),
+			Headers: d.getHeaders(opts.ForwardedHeaders),
 			Cookies: &cloudfront.CookiePreference{
 				Forward: aws.String("all"),
 			},
@@ -91,7 +144,7 @@ func (d *Distribution) fillDistributionConfig(config *cloudfront.DistributionCon
 			},
 		},
 		SmoothStreaming: aws.Bool(false),
-		DefaultTTL:      aws.Int64(86400),
+		DefaultTTL:      aws.Int64(opts.DefaultTTL),
 		MinTTL:          aws.Int64(0),
 		MaxTTL:          aws.Int64(31536000),
 		LambdaFunctionAssociations: &cloudfront.LambdaFunctionAssociations{
@@ -101,7 +154,7 @@ func (d *Distribution) fillDistributionConfig(config *cloudfront.DistributionCon
 			Enabled:  aws.Bool(false),
 			Quantity: aws.Int64(0),
 		},
-		ViewerProtocolPolicy: aws.String("redirect-to-https"),
+		ViewerProtocolPolicy: aws.String(opts.ViewerProtocolPolicy),
 		AllowedMethods: &cloudfront.AllowedMethods{
 			CachedMethods: &cloudfront.CachedMethods{
 				Quantity: aws.Int64(2),
@@ -121,105 +174,115 @@ func (d *Distribution) fillDistributionConfig(config *cloudfront.DistributionCon
 				aws.String("DELETE"),
 			},
 		},
-		Compress: aws.Bool(false),
+		Compress: aws.Bool(opts.Compress),
 	}
-	config.Origins = &cloudfront.Origins{
-		Quantity: aws.Int64(2),
-		Items: []*cloudfront.Origin{
-			{
-				DomainName: aws.String(origin),
-				Id:         aws.String(d.getOriginId(domains)),
-				OriginPath: aws.String(path),
-				CustomHeaders: &cloudfront.CustomHeaders{
-					Quantity: aws.Int64(0),
-				},
-				CustomOriginConfig: &cloudfront.CustomOriginConfig{
-					HTTPPort:             aws.Int64(80),
-					HTTPSPort:            aws.Int64(443),
-					OriginProtocolPolicy: getOriginProtocolPolicy(insecureOrigin),
-					OriginSslProtocols: &cloudfront.OriginSslProtocols{
-						Quantity: aws.Int64(3),
-						Items: []*string{
-							aws.String("TLSv1"),
-							aws.String("TLSv1.1"),
-							aws.String("TLSv1.2"),
-						},
-					},
-				},
+	origins := []*cloudfront.Origin{
+		{
+			DomainName: aws.String(opts.Origin),
+			Id:         aws.String(d.getOriginId(opts.Domains)),
+			OriginPath: aws.String(opts.Path),
+			CustomHeaders: &cloudfront.CustomHeaders{
+				Quantity: aws.Int64(0),
 			},
-			{
-				DomainName: aws.String(fmt.Sprintf("%s.s3.amazonaws.com", d.Settings.Bucket)),
-				Id:         aws.String(fmt.Sprintf("s3-%s-%s", d.Settings.Bucket, domains)),
-				OriginPath: aws.String(""),
-				CustomHeaders: &cloudfront.CustomHeaders{
-					Quantity: aws.Int64(0),
-				},
-				S3OriginConfig: &cloudfront.S3OriginConfig{
-					OriginAccessIdentity: aws.String(""),
+			CustomOriginConfig: &cloudfront.CustomOriginConfig{
+				HTTPPort:             aws.Int64(80),
+				HTTPSPort:            aws.Int64(443),
+				OriginProtocolPolicy: getOriginProtocolPolicy(opts.InsecureOrigin),
+				OriginSslProtocols: &cloudfront.OriginSslProtocols{
+					Quantity: aws.Int64(3),
+					Items: []*string{
+						aws.String("TLSv1"),
+						aws.String("TLSv1.1"),
+						aws.String("TLSv1.2"),
+					},
 				},
 			},
 		},
 	}
-	config.CacheBehaviors = &cloudfront.CacheBehaviors{
-		Quantity: aws.Int64(1),
-		Items: []*cloudfront.CacheBehavior{
-			{
-				AllowedMethods: &cloudfront.AllowedMethods{
-					CachedMethods: &cloudfront.CachedMethods{
-						Quantity: aws.Int64(2),
-						Items: []*string{
-							aws.String("HEAD"),
-							aws.String("GET"),
-						},
-					},
+
+	// The S3 origin and its cache behavior only exist to serve HTTP-01
+	// challenge responses at /.well-known/acme-challenge/*. DNS-01 proves
+	// domain ownership out-of-band via a Route53 TXT record, so it needs
+	// neither - this also lets DNS-01 be used for wildcard certs, which
+	// HTTP-01 can't issue at all.
+	cacheBehaviors := []*cloudfront.CacheBehavior{}
+	if opts.Challenge != ChallengeDNS01 {
+		origins = append(origins, &cloudfront.Origin{
+			DomainName: aws.String(fmt.Sprintf("%s.s3.amazonaws.com", d.Settings.Bucket)),
+			Id:         aws.String(fmt.Sprintf("s3-%s-%s", d.Settings.Bucket, opts.Domains)),
+			OriginPath: aws.String(""),
+			CustomHeaders: &cloudfront.CustomHeaders{
+				Quantity: aws.Int64(0),
+			},
+			S3OriginConfig: &cloudfront.S3OriginConfig{
+				OriginAccessIdentity: aws.String(d.getOriginAccessIdentity()),
+			},
+		})
+
+		cacheBehaviors = append(cacheBehaviors, &cloudfront.CacheBehavior{
+			AllowedMethods: &cloudfront.AllowedMethods{
+				CachedMethods: &cloudfront.CachedMethods{
+					Quantity: aws.Int64(2),
 					Items: []*string{
 						aws.String("HEAD"),
 						aws.String("GET"),
 					},
-					Quantity: aws.Int64(2),
 				},
-				Compress:       aws.Bool(false),
-				PathPattern:    aws.String("/.well-known/acme-challenge/*"),
-				TargetOriginId: aws.String(fmt.Sprintf("s3-%s-%s", d.Settings.Bucket, domains)),
-				ForwardedValues: &cloudfront.ForwardedValues{
-					Headers: &cloudfront.Headers{
-						Quantity: aws.Int64(0),
-					},
-					QueryString: aws.Bool(false),
-					Cookies: &cloudfront.CookiePreference{
-						Forward: aws.String("none"),
-					},
-					QueryStringCacheKeys: &cloudfront.QueryStringCacheKeys{
-						Quantity: aws.Int64(0),
-					},
+				Items: []*string{
+					aws.String("HEAD"),
+					aws.String("GET"),
 				},
-				SmoothStreaming: aws.Bool(false),
-				DefaultTTL:      aws.Int64(86400),
-				MinTTL:          aws.Int64(0),
-				MaxTTL:          aws.Int64(31536000),
-				LambdaFunctionAssociations: &cloudfront.LambdaFunctionAssociations{
+				Quantity: aws.Int64(2),
+			},
+			Compress:       aws.Bool(false),
+			PathPattern:    aws.String("/.well-known/acme-challenge/*"),
+			TargetOriginId: aws.String(fmt.Sprintf("s3-%s-%s", d.Settings.Bucket, opts.Domains)),
+			ForwardedValues: &cloudfront.ForwardedValues{
+				Headers: &cloudfront.Headers{
 					Quantity: aws.Int64(0),
 				},
-				TrustedSigners: &cloudfront.TrustedSigners{
-					Enabled:  aws.Bool(false),
+				QueryString: aws.Bool(false),
+				Cookies: &cloudfront.CookiePreference{
+					Forward: aws.String("none"),
+				},
+				QueryStringCacheKeys: &cloudfront.QueryStringCacheKeys{
 					Quantity: aws.Int64(0),
 				},
-				ViewerProtocolPolicy: aws.String("allow-all"),
 			},
-		},
+			SmoothStreaming: aws.Bool(false),
+			DefaultTTL:      aws.Int64(86400),
+			MinTTL:          aws.Int64(0),
+			MaxTTL:          aws.Int64(31536000),
+			LambdaFunctionAssociations: &cloudfront.LambdaFunctionAssociations{
+				Quantity: aws.Int64(0),
+			},
+			TrustedSigners: &cloudfront.TrustedSigners{
+				Enabled:  aws.Bool(false),
+				Quantity: aws.Int64(0),
+			},
+			ViewerProtocolPolicy: aws.String("allow-all"),
+		})
+	}
+
+	config.Origins = &cloudfront.Origins{
+		Quantity: aws.Int64(int64(len(origins))),
+		Items:    origins,
+	}
+	config.CacheBehaviors = &cloudfront.CacheBehaviors{
+		Quantity: aws.Int64(int64(len(cacheBehaviors))),
+		Items:    cacheBehaviors,
 	}
-	config.Aliases = d.getAliases(domains)
-	config.PriceClass = aws.String("PriceClass_100")
+	config.Aliases = d.getAliases(opts.Domains)
+	config.PriceClass = aws.String(opts.PriceClass)
 }
 
-func (d *Distribution) Create(domains []string, origin, path string, insecureOrigin bool, forwardedHeaders []string, tags map[string]string) (*cloudfront.Distribution, error) {
+func (d *Distribution) Create(opts DistributionOptions) (*cloudfront.Distribution, error) {
 	distConfig := new(cloudfront.DistributionConfig)
-	d.fillDistributionConfig(distConfig, origin, path, insecureOrigin,
-		aws.String(d.getDistributionId(domains)), domains, forwardedHeaders)
+	d.fillDistributionConfig(distConfig, aws.String(d.getDistributionId(opts.Domains)), opts)
 	resp, err := d.Service.CreateDistributionWithTags(&cloudfront.CreateDistributionWithTagsInput{
 		DistributionConfigWithTags: &cloudfront.DistributionConfigWithTags{
 			DistributionConfig: distConfig,
-			Tags:               d.getTags(tags),
+			Tags:               d.getTags(opts.Tags),
 		},
 	})
 
@@ -230,7 +293,7 @@ func (d *Distribution) Create(domains []string, origin, path string, insecureOri
 	return resp.Distribution, nil
 }
 
-func (d *Distribution) Update(distId string, domains []string, origin, path string, insecureOrigin bool, forwardedHeaders []string) (*cloudfront.Distribution, error) {
+func (d *Distribution) Update(distId string, opts DistributionOptions) (*cloudfront.Distribution, error) {
 	// Get the current distribution
 	dist, err := d.Service.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
 		Id: aws.String(distId),
@@ -238,8 +301,7 @@ func (d *Distribution) Update(distId string, domains []string, origin, path stri
 	if err != nil {
 		return nil, err
 	}
-	d.fillDistributionConfig(dist.DistributionConfig, origin, path, insecureOrigin,
-		dist.DistributionConfig.CallerReference, domains, forwardedHeaders)
+	d.fillDistributionConfig(dist.DistributionConfig, dist.DistributionConfig.CallerReference, opts)
 
 	// Call the UpdateDistribution function
 	resp, err := d.Service.UpdateDistribution(&cloudfront.UpdateDistributionInput{
@@ -263,7 +325,7 @@ func (d *Distribution) Get(distId string) (*cloudfront.Distribution, error) {
 	return resp.Distribution, nil
 }
 
-func (d *Distribution) SetCertificate(distId, certId string) error {
+func (d *Distribution) SetCertificate(distId string, opts CertificateOptions) error {
 	resp, err := d.Service.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
 		Id: aws.String(distId),
 	})
@@ -273,11 +335,11 @@ func (d *Distribution) SetCertificate(distId, certId string) error {
 
 	DistributionConfig, ETag := resp.DistributionConfig, resp.ETag
 
-	DistributionConfig.ViewerCertificate.Certificate = aws.String(certId)
-	DistributionConfig.ViewerCertificate.IAMCertificateId = aws.String(certId)
+	DistributionConfig.ViewerCertificate.Certificate = aws.String(opts.CertId)
+	DistributionConfig.ViewerCertificate.IAMCertificateId = aws.String(opts.CertId)
 	DistributionConfig.ViewerCertificate.CertificateSource = aws.String("iam")
-	DistributionConfig.ViewerCertificate.SSLSupportMethod = aws.String("sni-only")
-	DistributionConfig.ViewerCertificate.MinimumProtocolVersion = aws.String("TLSv1")
+	DistributionConfig.ViewerCertificate.SSLSupportMethod = aws.String(opts.SSLSupportMethod)
+	DistributionConfig.ViewerCertificate.MinimumProtocolVersion = aws.String(opts.MinimumProtocolVersion)
 	DistributionConfig.ViewerCertificate.CloudFrontDefaultCertificate = aws.Bool(false)
 
 	_, err = d.Service.UpdateDistribution(&cloudfront.UpdateDistributionInput{
@@ -329,6 +391,106 @@ func (d *Distribution) Delete(distId string) (bool, error) {
 	return err == nil, err
 }
 
+// Tag replaces the AWS resource tags on a distribution. Unlike Create,
+// Update can't carry tags as part of the distribution config, so this is a
+// separate TagResource call against the distribution's ARN.
+func (d *Distribution) Tag(distId string, tags map[string]string) error {
+	arn := fmt.Sprintf("arn:%s:cloudfront::%s:distribution/%s", d.Settings.AwsPartition, d.Settings.AwsAccountId, distId)
+
+	_, err := d.Service.TagResource(&cloudfront.TagResourceInput{
+		Resource: aws.String(arn),
+		Tags:     d.getTags(tags),
+	})
+
+	return err
+}
+
+// CreateInvalidation requests that CloudFront purge the given paths from its
+// edge caches and returns the AWS-assigned invalidation id along with the
+// caller reference actually sent, so RouteManager.Invalidate can persist the
+// real value instead of reconstructing its own guess at it.
+func (d *Distribution) CreateInvalidation(distId string, paths []string) (string, string, error) {
+	items := make([]*string, len(paths))
+	for idx, path := range paths {
+		items[idx] = aws.String(path)
+	}
+
+	callerReference := fmt.Sprintf("%s-%d", distId, time.Now().UnixNano())
+
+	resp, err := d.Service.CreateInvalidation(&cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(distId),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			CallerReference: aws.String(callerReference),
+			Paths: &cloudfront.Paths{
+				Quantity: aws.Int64(int64(len(items))),
+				Items:    items,
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return *resp.Invalidation.Id, callerReference, nil
+}
+
+// GetInvalidation returns the current status ("InProgress" or "Completed")
+// of a previously created invalidation.
+func (d *Distribution) GetInvalidation(distId, invalidationId string) (string, error) {
+	resp, err := d.Service.GetInvalidation(&cloudfront.GetInvalidationInput{
+		DistributionId: aws.String(distId),
+		Id:             aws.String(invalidationId),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *resp.Invalidation.Status, nil
+}
+
+// OriginAccessIdentityIface wraps the CloudFront origin access identity
+// (OAI) API. An OAI is a CloudFront "user" that can be granted read access
+// to a private S3 bucket, letting a distribution serve from a bucket that
+// isn't otherwise world-readable.
+type OriginAccessIdentityIface interface {
+	Create(comment string) (oaiId, canonicalUserId string, err error)
+	Delete(oaiId string) error
+}
+
+type OriginAccessIdentity struct {
+	Service *cloudfront.CloudFront
+}
+
+func (o *OriginAccessIdentity) Create(comment string) (string, string, error) {
+	resp, err := o.Service.CreateCloudFrontOriginAccessIdentity(&cloudfront.CreateCloudFrontOriginAccessIdentityInput{
+		CloudFrontOriginAccessIdentityConfig: &cloudfront.OriginAccessIdentityConfig{
+			CallerReference: aws.String(comment),
+			Comment:         aws.String(comment),
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return *resp.CloudFrontOriginAccessIdentity.Id, *resp.CloudFrontOriginAccessIdentity.S3CanonicalUserId, nil
+}
+
+func (o *OriginAccessIdentity) Delete(oaiId string) error {
+	resp, err := o.Service.GetCloudFrontOriginAccessIdentity(&cloudfront.GetCloudFrontOriginAccessIdentityInput{
+		Id: aws.String(oaiId),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = o.Service.DeleteCloudFrontOriginAccessIdentity(&cloudfront.DeleteCloudFrontOriginAccessIdentityInput{
+		Id:      aws.String(oaiId),
+		IfMatch: resp.ETag,
+	})
+
+	return err
+}
+
 func getOriginProtocolPolicy(insecure bool) *string {
 	if insecure {
 		return aws.String("http-only")
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// TestFillDistributionConfigPreservesCallerReference locks in the invariant
+// fillDistributionConfig documents: CallerReference is always whatever the
+// caller passes in, never re-derived from the (possibly changed) domain
+// list, since Update relies on it staying stable across a distribution's
+// lifetime.
+func TestFillDistributionConfigPreservesCallerReference(t *testing.T) {
+	d := &Distribution{}
+	config := new(cloudfront.DistributionConfig)
+	original := aws.String("cdn-route-example.com")
+
+	d.fillDistributionConfig(config, original, DistributionOptions{
+		Domains:   []string{"example.com"},
+		Challenge: ChallengeHTTP01,
+	})
+	if config.CallerReference != original {
+		t.Fatalf("expected CallerReference to be the pointer passed in, got %v", config.CallerReference)
+	}
+
+	d.fillDistributionConfig(config, original, DistributionOptions{
+		Domains:   []string{"changed.example.com", "other.example.com"},
+		Challenge: ChallengeHTTP01,
+	})
+	if config.CallerReference != original {
+		t.Fatalf("CallerReference pointer changed after domains changed: got %v, want %v", config.CallerReference, original)
+	}
+	if *config.CallerReference != "cdn-route-example.com" {
+		t.Fatalf("CallerReference value changed after domains changed: got %s", *config.CallerReference)
+	}
+}
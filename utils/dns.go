@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Route53 hosted zone ids for the CloudFront edge network, used as the
+// AliasTarget.HostedZoneId when pointing an ALIAS record at a distribution.
+// There's one per AWS partition CloudFront serves from; see
+// http://docs.aws.amazon.com/general/latest/gr/rande.html#cf_region.
+const (
+	CloudFrontHostedZoneIdStandard = "Z2FDTNDATAQYW2"
+	CloudFrontHostedZoneIdChina    = "Z3RFFRIM2A3IF5"
+)
+
+// CloudFrontHostedZoneId returns the ALIAS target hosted zone id for the
+// given AWS partition ("aws", "aws-cn", ...), defaulting to the standard
+// partition.
+func CloudFrontHostedZoneId(partition string) string {
+	if partition == "aws-cn" {
+		return CloudFrontHostedZoneIdChina
+	}
+	return CloudFrontHostedZoneIdStandard
+}
+
+// DNSIface manages the Route53 ALIAS records that point a route's external
+// domains at its CloudFront distribution, so operators don't have to create
+// a CNAME by hand before a distribution can finish provisioning.
+type DNSIface interface {
+	CreateAlias(hostedZoneId, domain, target string) error
+	DeleteAlias(hostedZoneId, domain, target string) error
+}
+
+type DNS struct {
+	Service                *route53.Route53
+	CloudFrontHostedZoneId string
+}
+
+func (d *DNS) CreateAlias(hostedZoneId, domain, target string) error {
+	return d.changeAlias(route53.ChangeActionUpsert, hostedZoneId, domain, target)
+}
+
+func (d *DNS) DeleteAlias(hostedZoneId, domain, target string) error {
+	return d.changeAlias(route53.ChangeActionDelete, hostedZoneId, domain, target)
+}
+
+// changeAlias submits both the A and AAAA ALIAS records in a single change
+// batch, since a distribution is dual-stack (IsIPV6Enabled) by default.
+func (d *DNS) changeAlias(action, hostedZoneId, domain, target string) error {
+	changes := make([]*route53.Change, 0, 2)
+	for _, recordType := range []string{route53.RRTypeA, route53.RRTypeAaaa} {
+		changes = append(changes, &route53.Change{
+			Action: aws.String(action),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name: aws.String(domain),
+				Type: aws.String(recordType),
+				AliasTarget: &route53.AliasTarget{
+					HostedZoneId:         aws.String(d.CloudFrontHostedZoneId),
+					DNSName:              aws.String(target),
+					EvaluateTargetHealth: aws.Bool(false),
+				},
+			},
+		})
+	}
+
+	_, err := d.Service.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneId),
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: changes,
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,54 @@
+package utils
+
+import "fmt"
+
+// allowedMinimumProtocolVersions mirrors the MinimumProtocolVersion values
+// CloudFront's API will actually accept for a ViewerCertificate; see
+// http://docs.aws.amazon.com/cloudfront/latest/APIReference/API_ViewerCertificate.html
+var allowedMinimumProtocolVersions = map[string]bool{
+	"SSLv3":        true,
+	"TLSv1":        true,
+	"TLSv1_2016":   true,
+	"TLSv1.1_2016": true,
+	"TLSv1.2_2018": true,
+	"TLSv1.2_2019": true,
+	"TLSv1.2_2021": true,
+}
+
+// ValidateMinimumProtocolVersion rejects MinimumProtocolVersion overrides
+// CloudFront wouldn't accept, so a bad plan/instance parameter fails at
+// request time instead of surfacing as an opaque CloudFront API error.
+func ValidateMinimumProtocolVersion(version string) error {
+	if !allowedMinimumProtocolVersions[version] {
+		return fmt.Errorf("invalid minimum protocol version: %s", version)
+	}
+	return nil
+}
+
+// ValidateChallengeProvider rejects anything other than the two
+// ChallengeProvider values Create/Update know how to wire up.
+func ValidateChallengeProvider(challenge ChallengeProvider) error {
+	switch challenge {
+	case ChallengeHTTP01, ChallengeDNS01:
+		return nil
+	default:
+		return fmt.Errorf("invalid challenge provider: %s", challenge)
+	}
+}
+
+// ValidateSSLSupportMethod rejects "vip" (dedicated IP) unless the broker
+// has opted a plan into it, since dedicated IP custom SSL carries a
+// significant extra CloudFront cost operators shouldn't hit by accident.
+func ValidateSSLSupportMethod(method string, allowDedicatedIP bool) error {
+	switch method {
+	case "sni-only":
+		return nil
+	case "vip":
+		if allowDedicatedIP {
+			return nil
+		}
+		return fmt.Errorf("SSL support method %q requires the plan to opt into dedicated-IP custom SSL (extra cost)", method)
+	default:
+		return fmt.Errorf("invalid SSL support method: %s", method)
+	}
+}